@@ -0,0 +1,135 @@
+package framed
+
+import (
+	"context"
+	"time"
+)
+
+// aLongTimeAgo is used to unblock an in-flight Read or Write once ctx is
+// done, the same trick the net package uses internally to implement
+// SetDeadline-based cancellation.
+var aLongTimeAgo = time.Unix(1, 0)
+
+type readDeadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadlineSetter interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+/*
+ReadFrameContext is like ReadFrame, but returns ctx.Err() once ctx is
+cancelled or its deadline passes instead of blocking forever. If Stream
+implements SetReadDeadline (as net.Conn does), ctx's deadline is propagated
+to it, and a watchdog goroutine forces the in-flight read to return by
+resetting the deadline to a moment in the past as soon as ctx is done.
+If Stream doesn't implement SetReadDeadline, ctx is not consulted at all and
+the call blocks just as ReadFrame does.
+Without this, a stuck peer during the two-phase header-then-body read in
+ReadFrame can wedge a goroutine forever holding the Reader's mutex.
+
+The whole deadline-set/read/deadline-reset sequence runs with the Reader's
+mutex held, the same as Read and ReadFrame, so a deadline set here can never
+be observed by, or interfere with, an unrelated Read/ReadFrame/
+ReadFrameContext call on the same Reader.
+*/
+func (framed *Reader) ReadFrameContext(ctx context.Context) (frame []byte, err error) {
+	framed.mutex.Lock()
+	defer framed.mutex.Unlock()
+
+	conn, ok := framed.Stream.(readDeadlineSetter)
+	if !ok {
+		return framed.readFrameLocked()
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	done := make(chan struct{})
+	watchdogDone := make(chan struct{})
+	// Wait for the watchdog to exit before the deadline reset above runs, so
+	// it can't set aLongTimeAgo after that reset.
+	defer func() {
+		close(done)
+		<-watchdogDone
+	}()
+	go func() {
+		defer close(watchdogDone)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	frame, err = framed.readFrameLocked()
+	if err != nil && hasDeadline && !time.Now().Before(deadline) {
+		// Stream's deadline can fire a moment before ctx's own timer does.
+		<-ctx.Done()
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return frame, err
+}
+
+/*
+WriteContext is like Write, but returns ctx.Err() once ctx is cancelled or
+its deadline passes instead of blocking forever. It propagates ctx's
+deadline and cancellation to Stream the same way ReadFrameContext does, when
+Stream implements SetWriteDeadline, and likewise holds the Writer's mutex
+for the whole sequence so the deadline it sets can't affect an unrelated
+Write/WriteContext call on the same Writer. If Stream doesn't implement
+SetWriteDeadline, ctx is not consulted at all and the call blocks just as
+Write does.
+*/
+func (framed *Writer) WriteContext(ctx context.Context, frame []byte) (n int, err error) {
+	framed.mutex.Lock()
+	defer framed.mutex.Unlock()
+
+	conn, ok := framed.Stream.(writeDeadlineSetter)
+	if !ok {
+		return framed.writeLocked(frame)
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err = conn.SetWriteDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	defer conn.SetWriteDeadline(time.Time{})
+
+	done := make(chan struct{})
+	watchdogDone := make(chan struct{})
+	// As in ReadFrameContext, wait for the watchdog to exit before the
+	// deadline reset above runs.
+	defer func() {
+		close(done)
+		<-watchdogDone
+	}()
+	go func() {
+		defer close(watchdogDone)
+		select {
+		case <-ctx.Done():
+			conn.SetWriteDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	n, err = framed.writeLocked(frame)
+	if err != nil && hasDeadline && !time.Now().Before(deadline) {
+		// Stream's deadline can fire a moment before ctx's own timer does.
+		<-ctx.Done()
+	}
+	if err != nil && ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
@@ -2,19 +2,20 @@
 Package framed provides an implementation of io.ReadWriteCloser that reads and
 writes whole frames only.
 
-Frames are length-prefixed.  The first two bytes are an unsigned 16 bit int
-stored in little-endian byte order indicating the length of the content.  The
-remaining bytes are the actual content of the frame.
-
-The use of a uint16 means that the maximum possible frame size (MAX_FRAME_SIZE)
-is 65535.
+Frames are length-prefixed.  By default, the first two bytes are an unsigned
+16 bit int stored in little-endian byte order indicating the length of the
+content, capping the maximum possible frame size (MAX_FRAME_SIZE) at 65535.
+Readers and Writers can opt into other length-prefix encodings via Prefix;
+see PrefixEncoding.
 */
 package framed
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 )
 
@@ -37,7 +38,21 @@ goroutines, a framed.Reader is not.
 */
 type Reader struct {
 	Stream io.Reader // the raw underlying connection
-	mutex  sync.Mutex
+	// Prefix selects how the length prefix preceding each frame is decoded.
+	// It defaults to Uint16LE.
+	Prefix PrefixEncoding
+	// MaxFrameLength caps the size of a single frame's content. It is
+	// enforced immediately after the length prefix is decoded, before any
+	// memory is allocated for the frame itself, so a hostile or corrupt
+	// length can't be used to force a huge allocation. If left at zero, it
+	// defaults based on Prefix: MAX_FRAME_SIZE for Uint16LE (which can't
+	// encode a longer length anyway), or a much higher bound for Uint32BE
+	// and Uvarint, since those exist specifically to carry frames bigger
+	// than MAX_FRAME_SIZE. Set it explicitly to pick a tighter bound.
+	MaxFrameLength int
+	br             *bufio.Reader // set only by NewReaderSize; amortizes Uvarint's per-byte reads
+	pool           BufferPool    // set only by NewReaderWithPool; backs ReadFrameFromPool
+	mutex          sync.Mutex
 }
 
 /*
@@ -51,6 +66,9 @@ underlying stream as a single frame.
 */
 type Writer struct {
 	Stream io.Writer // the raw underlying connection
+	// Prefix selects how the length prefix preceding each frame is encoded.
+	// It defaults to Uint16LE.
+	Prefix PrefixEncoding
 	mutex  sync.Mutex
 }
 
@@ -58,6 +76,16 @@ func NewReader(r io.Reader) *Reader {
 	return &Reader{Stream: r}
 }
 
+/*
+NewReaderSize is like NewReader, but wraps r in a *bufio.Reader of the given
+size so that a Uvarint length prefix (see PrefixEncoding) can be decoded a
+byte at a time without a syscall per byte.
+*/
+func NewReaderSize(r io.Reader, size int) *Reader {
+	br := bufio.NewReaderSize(r, size)
+	return &Reader{Stream: br, br: br}
+}
+
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{Stream: w}
 }
@@ -70,25 +98,69 @@ by a framed.Writer).
 func (framed *Reader) Read(buffer []byte) (n int, err error) {
 	framed.mutex.Lock()
 	defer framed.mutex.Unlock()
+	return framed.readLocked(buffer)
+}
 
-	var nb uint16
-	err = binary.Read(framed.Stream, endianness, &nb)
+// readLocked is Read's implementation, factored out so that
+// ReadFrameContext can hold framed.mutex across the whole
+// deadline-set/read/deadline-reset sequence rather than just the read
+// itself.
+func (framed *Reader) readLocked(buffer []byte) (n int, err error) {
+	nb, err := framed.readLengthPrefix()
 	if err != nil {
-		return
+		return 0, err
+	}
+	if err = framed.checkMaxFrameLength(nb); err != nil {
+		return 0, err
 	}
-
-	n = int(nb)
 
 	bufferSize := len(buffer)
-	if n > bufferSize {
-		return 0, fmt.Errorf("Buffer of size %d is too small to hold frame of size %d", bufferSize, n)
+	if nb > bufferSize {
+		return 0, fmt.Errorf("Buffer of size %d is too small to hold frame of size %d", bufferSize, nb)
 	}
 
 	// Read into buffer
-	n, err = io.ReadFull(framed.Stream, buffer[:n])
+	n, err = io.ReadFull(framed.Stream, buffer[:nb])
 	return
 }
 
+/*
+ReadFrame is like Read, but it allocates and returns a buffer sized to fit
+the frame rather than requiring the caller to supply one.
+*/
+func (framed *Reader) ReadFrame() (frame []byte, err error) {
+	framed.mutex.Lock()
+	defer framed.mutex.Unlock()
+	return framed.readFrameLocked()
+}
+
+// readFrameLocked is ReadFrame's implementation, factored out for the same
+// reason as readLocked.
+func (framed *Reader) readFrameLocked() (frame []byte, err error) {
+	nb, err := framed.readLengthPrefix()
+	if err != nil {
+		return nil, err
+	}
+	if err = framed.checkMaxFrameLength(nb); err != nil {
+		return nil, err
+	}
+
+	frame = make([]byte, nb)
+	_, err = io.ReadFull(framed.Stream, frame)
+	return
+}
+
+func (framed *Reader) checkMaxFrameLength(n int) error {
+	max := framed.MaxFrameLength
+	if max <= 0 {
+		max = framed.defaultMaxFrameLength()
+	}
+	if n > max {
+		return fmt.Errorf("Frame of size %d exceeds MaxFrameLength of %d", n, max)
+	}
+	return nil
+}
+
 /*
 Write implements the Write method from io.Writer.  It prepends a frame length
 header that allows the framed.Reader on the other end to read the whole frame.
@@ -96,11 +168,17 @@ header that allows the framed.Reader on the other end to read the whole frame.
 func (framed *Writer) Write(frame []byte) (n int, err error) {
 	framed.mutex.Lock()
 	defer framed.mutex.Unlock()
+	return framed.writeLocked(frame)
+}
 
+// writeLocked is Write's implementation, factored out so that WriteContext
+// can hold framed.mutex across the whole deadline-set/write/deadline-reset
+// sequence rather than just the write itself.
+func (framed *Writer) writeLocked(frame []byte) (n int, err error) {
 	n = len(frame)
 
 	// Write the length header
-	if err = binary.Write(framed.Stream, endianness, uint16(n)); err != nil {
+	if err = framed.writeLengthPrefix(n); err != nil {
 		return
 	}
 
@@ -115,6 +193,13 @@ func (framed *Writer) Write(frame []byte) (n int, err error) {
 	return
 }
 
+/*
+WritePieces writes the concatenation of pieces as a single frame. It
+coalesces the length header and all pieces into one net.Buffers.WriteTo
+call, so that when Stream is a *net.TCPConn (or anything else implementing
+vectored writes) the kernel sees a single writev instead of a Write per
+piece.
+*/
 func (framed *Writer) WritePieces(pieces ...[]byte) (n int, err error) {
 	framed.mutex.Lock()
 	defer framed.mutex.Unlock()
@@ -123,22 +208,20 @@ func (framed *Writer) WritePieces(pieces ...[]byte) (n int, err error) {
 		n = n + len(piece)
 	}
 
-	// Write the length header
-	if err = binary.Write(framed.Stream, endianness, uint16(n)); err != nil {
-		return
-	}
+	header := framed.encodeLengthPrefix(n)
+	bufs := make(net.Buffers, 0, len(pieces)+1)
+	bufs = append(bufs, header)
+	bufs = append(bufs, pieces...)
 
-	// Write the data
-	var written int
-	for _, piece := range pieces {
-		var nw int
-		if nw, err = framed.Stream.Write(piece); err != nil {
-			return
-		}
-		written = written + nw
+	// WriteTo consumes bufs as it writes, so capture the expected total
+	// before calling it rather than reading back from bufs afterward.
+	want := int64(n + len(header))
+	written, err := bufs.WriteTo(framed.Stream)
+	if err != nil {
+		return 0, err
 	}
-	if written != n {
-		err = fmt.Errorf("%d bytes written, expected to write %d", written, n)
+	if written != want {
+		err = fmt.Errorf("%d bytes written, expected to write %d", written, want)
 	}
 	return
 }
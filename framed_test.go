@@ -1,9 +1,12 @@
 package framed
 
 import (
+	"context"
+	"encoding/binary"
 	"io"
-	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
 	"testing"
 	"time"
 
@@ -37,32 +40,31 @@ func (p *pipe) Write(data []byte) (n int, err error) {
 }
 
 func TestSmallFrames(t *testing.T) {
-	doTestFrames(t, 20)
+	doTestFrames(t, Uint16LE, 20)
 }
 
 func TestBigFrames(t *testing.T) {
-	doTestFrames(t, MaxFrameLength+1)
+	doTestFrames(t, Uint32BE, MAX_FRAME_SIZE+1)
 }
 
-func doTestFrames(t *testing.T, msgLength int) {
-	pool := NewHeaderPreservingBufferPool(1, msgLength, msgLength > MaxFrameLength)
-	testMessage := pool.GetSlice()
-	defer pool.PutSlice(testMessage)
-	rand.Read(testMessage.Bytes())
+func TestVarintFrames(t *testing.T) {
+	doTestFrames(t, Uvarint, MAX_FRAME_SIZE+1)
+}
+
+func doTestFrames(t *testing.T, prefix PrefixEncoding, msgLength int) {
+	testMessage := make([]byte, msgLength)
+	rand.Read(testMessage)
 
-	cutoff := len(testMessage.Bytes()) / 2
-	piece1 := testMessage.Bytes()[:cutoff]
-	piece2 := testMessage.Bytes()[cutoff:]
+	cutoff := len(testMessage) / 2
+	piece1 := testMessage[:cutoff]
+	piece2 := testMessage[cutoff:]
 
 	p := newPipe()
 	defer p.Close()
 	writer := NewWriter(p)
+	writer.Prefix = prefix
 	reader := NewReader(p)
-	if msgLength > MaxFrameLength {
-		writer.EnableBigFrames()
-		reader.EnableBigFrames()
-	}
-	reader.EnableBuffering(msgLength)
+	reader.Prefix = prefix
 
 	// Do a bunch of concurrent reads and writes to make sure we're threadsafe
 	iters := 100
@@ -72,7 +74,6 @@ func doTestFrames(t *testing.T, msgLength int) {
 	for i := 0; i < iters; i++ {
 		writePieces := i%2 == 0
 		readFrame := i%3 == 0
-		writeAtomic := !writePieces && i%5 == 0
 
 		go func() {
 			defer func() {
@@ -84,15 +85,13 @@ func doTestFrames(t *testing.T, msgLength int) {
 			var err error
 			if writePieces {
 				n, err = writer.WritePieces(piece1, piece2)
-			} else if writeAtomic {
-				n, err = writer.WriteAtomic(testMessage)
 			} else {
-				n, err = writer.Write(testMessage.Bytes())
+				n, err = writer.Write(testMessage)
 			}
 			if err != nil {
 				t.Errorf("Unable to write: %s", err)
 			} else {
-				assert.Equal(t, len(testMessage.Bytes()), n, "Bytes written should match length of test message")
+				assert.Equal(t, len(testMessage), n, "Bytes written should match length of test message")
 			}
 		}()
 
@@ -105,7 +104,7 @@ func doTestFrames(t *testing.T, msgLength int) {
 			var frame []byte
 			var n int
 			var err error
-			buffer := make([]byte, len(testMessage.Bytes()))
+			buffer := make([]byte, len(testMessage))
 
 			if readFrame {
 				if frame, err = reader.ReadFrame(); err != nil {
@@ -117,12 +116,12 @@ func doTestFrames(t *testing.T, msgLength int) {
 					t.Errorf("Unable to read: %s", err)
 					return
 				} else {
-					assert.Equal(t, len(testMessage.Bytes()), n, "Bytes read should match length of test message")
+					assert.Equal(t, len(testMessage), n, "Bytes read should match length of test message")
 				}
 				frame = buffer[:n]
 			}
 
-			assert.Equal(t, testMessage.Bytes(), frame, "Received should match sent")
+			assert.Equal(t, testMessage, frame, "Received should match sent")
 		}()
 	}
 
@@ -147,25 +146,95 @@ func doTestFrames(t *testing.T, msgLength int) {
 	}
 }
 
-func TestWriteTooLong(t *testing.T) {
-	w := NewWriter(ioutil.Discard)
-	b := make([]byte, MaxFrameLength+1)
-	n, err := w.Write(b)
-	assert.Error(t, err, "Writing too long message should result in error")
-	assert.Equal(t, 0, n, "Writing too long message should result in 0 bytes written")
-	n, err = w.Write(b[:len(b)-1])
-	assert.NoError(t, err, "Writing message of MaxFrameLength should be allowed")
-	assert.Equal(t, MaxFrameLength, n, "Writing message of MaxFrameLength should have written MaxFrameLength bytes")
+func TestMaxFrameLengthEnforcedOnRead(t *testing.T) {
+	p := newPipe()
+	defer p.Close()
+
+	writer := NewWriter(p)
+	writer.Prefix = Uvarint
+	reader := NewReader(p)
+	reader.Prefix = Uvarint
+	reader.MaxFrameLength = 10
+
+	go writer.Write(make([]byte, 20))
+
+	n, err := reader.Read(make([]byte, 20))
+	assert.Error(t, err, "Reading a frame over MaxFrameLength should fail")
+	assert.Equal(t, 0, n, "Reading a frame over MaxFrameLength should read 0 bytes")
 }
 
-func TestWritePiecesTooLong(t *testing.T) {
-	w := NewWriter(ioutil.Discard)
-	b1 := make([]byte, MaxFrameLength)
-	b2 := make([]byte, 1)
-	n, err := w.WritePieces(b1, b2)
-	assert.Error(t, err, "Writing too long message should result in error")
-	assert.Equal(t, 0, n, "Writing too long message should result in 0 bytes written")
-	n, err = w.WritePieces(b1[:len(b1)-1], b2)
-	assert.NoError(t, err, "Writing message of MaxFrameLength should be allowed")
-	assert.Equal(t, MaxFrameLength, n, "Writing message of MaxFrameLength should have written MaxFrameLength bytes")
+func TestMaxFrameLengthEnforcedOnReadFrame(t *testing.T) {
+	p := newPipe()
+	defer p.Close()
+
+	writer := NewWriter(p)
+	writer.Prefix = Uvarint
+	reader := NewReader(p)
+	reader.Prefix = Uvarint
+	reader.MaxFrameLength = 10
+
+	go writer.Write(make([]byte, 20))
+
+	_, err := reader.ReadFrame()
+	assert.Error(t, err, "Reading a frame over MaxFrameLength should fail")
+}
+
+// TestUvarintFrameLengthOverflowRejected guards against a peer encoding a
+// length too large for a Go int, such as math.MaxUint64, in a Uvarint
+// prefix, which would otherwise overflow int(nb) to a negative value, sail through checkMaxFrameLength
+// (which only rejects lengths that are too big, not negative), and panic in
+// make([]byte, nb) or buffer[:nb].
+func TestUvarintFrameLengthOverflowRejected(t *testing.T) {
+	p := newPipe()
+	defer p.Close()
+
+	reader := NewReader(p)
+	reader.Prefix = Uvarint
+
+	go func() {
+		buf := make([]byte, binary.MaxVarintLen64)
+		nw := binary.PutUvarint(buf, math.MaxUint64)
+		p.Write(buf[:nw])
+	}()
+
+	_, err := reader.ReadFrame()
+	assert.Error(t, err, "A Uvarint length beyond math.MaxInt32 should be rejected, not panic")
+}
+
+// TestReadFrameContextResetsDeadlineAfterCancellation guards against a
+// regression where a cancelled ReadFrameContext call left the underlying
+// connection's read deadline pinned in the past, wedging every later
+// Read/ReadFrame/ReadFrameContext call on the same Reader.
+func TestReadFrameContextResetsDeadlineAfterCancellation(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	reader := NewReader(serverConn)
+	writer := NewWriter(clientConn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := reader.ReadFrameContext(ctx); err == nil {
+		t.Fatal("ReadFrameContext should have failed after ctx was cancelled")
+	}
+
+	// A later call on the same Reader must not still be affected by the
+	// deadline the cancelled call above set on the shared connection.
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := writer.Write([]byte("hello"))
+		writeDone <- err
+	}()
+
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatalf("Unable to read frame after earlier cancellation: %s", err)
+	}
+	assert.Equal(t, []byte("hello"), frame, "Should have read frame written after cancellation")
+
+	if err := <-writeDone; err != nil {
+		t.Fatalf("Unable to write: %s", err)
+	}
 }
@@ -0,0 +1,76 @@
+package framed
+
+import "fmt"
+
+/*
+A FrameType identifies the kind of payload carried by a single frame when
+using the typed-frame helpers below. It occupies the first byte of the
+frame's content, immediately followed by the payload.
+*/
+type FrameType byte
+
+/*
+WriteTypedFrame writes a single frame consisting of t followed by the
+concatenation of payload. It lets callers layer control messages (keepalive,
+close, info, ...) and multiple data streams over one framed connection,
+while still using the same wire format as Write and WritePieces. The
+returned n is the number of payload bytes written, not counting t.
+*/
+func (framed *Writer) WriteTypedFrame(t FrameType, payload ...[]byte) (n int, err error) {
+	pieces := make([][]byte, 0, len(payload)+1)
+	pieces = append(pieces, []byte{byte(t)})
+	pieces = append(pieces, payload...)
+
+	written, err := framed.WritePieces(pieces...)
+	if err != nil {
+		return 0, err
+	}
+	return written - 1, nil
+}
+
+/*
+ReadTypedFrame reads a single frame written by WriteTypedFrame, returning its
+FrameType and the payload that followed it.
+*/
+func (framed *Reader) ReadTypedFrame() (t FrameType, payload []byte, err error) {
+	frame, err := framed.ReadFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(frame) < 1 {
+		return 0, nil, fmt.Errorf("frame of length %d is too short to contain a FrameType", len(frame))
+	}
+	return FrameType(frame[0]), frame[1:], nil
+}
+
+/*
+A Mux dispatches typed frames read from a Reader to per-FrameType handlers,
+making it possible to demultiplex several logical streams or control
+messages that have been layered over a single framed connection.
+*/
+type Mux struct {
+	Handlers map[FrameType]func([]byte) error
+}
+
+/*
+ServeFrames reads typed frames from r in a loop, dispatching each one to the
+handler registered for its FrameType, until reading a frame fails (for
+example with io.EOF once the underlying stream is closed) or a handler
+returns an error.
+*/
+func (m *Mux) ServeFrames(r *Reader) error {
+	for {
+		t, payload, err := r.ReadTypedFrame()
+		if err != nil {
+			return err
+		}
+
+		handle, found := m.Handlers[t]
+		if !found {
+			return fmt.Errorf("no handler registered for frame type %d", t)
+		}
+		if err := handle(payload); err != nil {
+			return err
+		}
+	}
+}
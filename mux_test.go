@@ -0,0 +1,113 @@
+package framed
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestWriteTypedFrameRoundTrip(t *testing.T) {
+	p := newPipe()
+	defer p.Close()
+
+	writer := NewWriter(p)
+	reader := NewReader(p)
+
+	go func() {
+		n, err := writer.WriteTypedFrame(FrameType(7), []byte("hello "), []byte("world"))
+		assert.NoError(t, err, "Unable to write typed frame")
+		assert.Equal(t, len("hello world"), n, "WriteTypedFrame should report payload length, not counting the type byte")
+	}()
+
+	typ, payload, err := reader.ReadTypedFrame()
+	if assert.NoError(t, err, "Unable to read typed frame") {
+		assert.Equal(t, FrameType(7), typ, "Wrong FrameType read back")
+		assert.Equal(t, "hello world", string(payload), "Wrong payload read back")
+	}
+}
+
+func TestReadTypedFrameTooShort(t *testing.T) {
+	p := newPipe()
+	defer p.Close()
+
+	writer := NewWriter(p)
+	reader := NewReader(p)
+
+	go writer.Write([]byte{})
+
+	_, _, err := reader.ReadTypedFrame()
+	assert.Error(t, err, "Reading a frame too short to contain a FrameType should fail")
+}
+
+func TestServeFrames(t *testing.T) {
+	const (
+		typeEcho FrameType = iota
+		typeStop
+	)
+
+	p := newPipe()
+	defer p.Close()
+
+	writer := NewWriter(p)
+	reader := NewReader(p)
+
+	var echoed []string
+	mux := &Mux{
+		Handlers: map[FrameType]func([]byte) error{
+			typeEcho: func(payload []byte) error {
+				echoed = append(echoed, string(payload))
+				return nil
+			},
+			typeStop: func(payload []byte) error {
+				return fmt.Errorf("stopping")
+			},
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mux.ServeFrames(reader)
+	}()
+
+	_, err := writer.WriteTypedFrame(typeEcho, []byte("one"))
+	assert.NoError(t, err, "Unable to write frame")
+	_, err = writer.WriteTypedFrame(typeEcho, []byte("two"))
+	assert.NoError(t, err, "Unable to write frame")
+	_, err = writer.WriteTypedFrame(typeStop)
+	assert.NoError(t, err, "Unable to write frame")
+
+	assert.Equal(t, "stopping", (<-done).Error(), "ServeFrames should return the handler's error")
+	assert.Equal(t, []string{"one", "two"}, echoed, "ServeFrames should dispatch frames to handlers in order")
+}
+
+func TestServeFramesUnknownFrameType(t *testing.T) {
+	p := newPipe()
+	defer p.Close()
+
+	writer := NewWriter(p)
+	reader := NewReader(p)
+
+	mux := &Mux{Handlers: map[FrameType]func([]byte) error{}}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mux.ServeFrames(reader)
+	}()
+
+	_, err := writer.WriteTypedFrame(FrameType(99), []byte("payload"))
+	assert.NoError(t, err, "Unable to write frame")
+
+	assert.Error(t, <-done, "ServeFrames should fail when no handler is registered for a FrameType")
+}
+
+func TestServeFramesStopsOnReadError(t *testing.T) {
+	p := newPipe()
+	reader := NewReader(p)
+	mux := &Mux{Handlers: map[FrameType]func([]byte) error{}}
+
+	p.Close()
+	err := mux.ServeFrames(reader)
+	assert.Equal(t, io.EOF, err, "ServeFrames should return the underlying Read error")
+}
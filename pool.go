@@ -0,0 +1,160 @@
+package framed
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+A BufferPool is implemented by allocators that can hand out reusable byte
+slices of at least n bytes and take them back once the caller is done with
+them, so that a Reader can serve ReadFrameFromPool without allocating on
+every frame.
+*/
+type BufferPool interface {
+	Get(n int) *[]byte
+	Put(buf *[]byte)
+}
+
+/*
+SyncPoolBufferPool is the default BufferPool. It's backed by a set of
+sync.Pools bucketed by power-of-two size, so that buffers of similar sizes
+get reused rather than every Get resulting in a fresh allocation.
+*/
+type SyncPoolBufferPool struct {
+	pools sync.Map // bucket size (int) -> *sync.Pool
+}
+
+// NewSyncPoolBufferPool creates a ready to use SyncPoolBufferPool.
+func NewSyncPoolBufferPool() *SyncPoolBufferPool {
+	return &SyncPoolBufferPool{}
+}
+
+// bucketFor rounds n up to the next power of two. n beyond
+// math.MaxInt32 is capped at math.MaxInt32 instead of continuing to
+// double, since doubling an int past its highest bit would overflow to a
+// negative number and loop forever.
+func bucketFor(n int) int {
+	if n > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	bucket := 1
+	for bucket < n {
+		bucket <<= 1
+	}
+	return bucket
+}
+
+func (p *SyncPoolBufferPool) poolFor(bucket int) *sync.Pool {
+	if existing, ok := p.pools.Load(bucket); ok {
+		return existing.(*sync.Pool)
+	}
+	pool := &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, bucket)
+			return &buf
+		},
+	}
+	actual, _ := p.pools.LoadOrStore(bucket, pool)
+	return actual.(*sync.Pool)
+}
+
+func (p *SyncPoolBufferPool) Get(n int) *[]byte {
+	bucket := bucketFor(n)
+	if bucket < n {
+		// bucketFor capped the bucket below n, so no pooled buffer is big
+		// enough; allocate one of exactly n bytes instead.
+		buf := make([]byte, n)
+		return &buf
+	}
+	buf := p.poolFor(bucket).Get().(*[]byte)
+	*buf = (*buf)[:n]
+	return buf
+}
+
+func (p *SyncPoolBufferPool) Put(buf *[]byte) {
+	bucket := cap(*buf)
+	*buf = (*buf)[:bucket]
+	p.poolFor(bucket).Put(buf)
+}
+
+/*
+A PooledFrame is a frame whose backing buffer was drawn from a BufferPool by
+Reader.ReadFrameFromPool. Callers must call Release exactly once when done
+with the frame's Bytes, returning the buffer to its pool. Calling Bytes
+after Release, or calling Release twice, panics rather than silently
+corrupting a buffer that's since been handed to someone else.
+*/
+type PooledFrame struct {
+	pool     BufferPool
+	buf      *[]byte
+	length   int
+	released int32
+}
+
+// Bytes returns the frame's content. It's only valid until Release is called.
+func (pf *PooledFrame) Bytes() []byte {
+	if atomic.LoadInt32(&pf.released) != 0 {
+		panic("framed: use of PooledFrame after Release")
+	}
+	return (*pf.buf)[:pf.length]
+}
+
+// Release returns the frame's backing buffer to its pool.
+func (pf *PooledFrame) Release() {
+	if !atomic.CompareAndSwapInt32(&pf.released, 0, 1) {
+		panic("framed: PooledFrame released more than once")
+	}
+	pf.pool.Put(pf.buf)
+}
+
+/*
+NewReaderWithPool is like NewReader, but configures the Reader to draw
+buffers for ReadFrameFromPool from pool.
+*/
+func NewReaderWithPool(r io.Reader, pool BufferPool) *Reader {
+	return &Reader{Stream: r, pool: pool}
+}
+
+/*
+ReadFrameFromPool reads a single frame into a buffer drawn from the
+Reader's BufferPool (see NewReaderWithPool), avoiding the per-message
+allocation that Read and ReadFrame otherwise require. The caller must call
+the returned PooledFrame's Release method once it's done with the frame's
+bytes.
+*/
+func (framed *Reader) ReadFrameFromPool() (*PooledFrame, error) {
+	if framed.pool == nil {
+		return nil, fmt.Errorf("ReadFrameFromPool requires a Reader constructed with NewReaderWithPool")
+	}
+
+	framed.mutex.Lock()
+	defer framed.mutex.Unlock()
+
+	nb, err := framed.readLengthPrefix()
+	if err != nil {
+		return nil, err
+	}
+	if err = framed.checkMaxFrameLength(nb); err != nil {
+		return nil, err
+	}
+
+	buf := framed.pool.Get(nb)
+	if _, err := io.ReadFull(framed.Stream, *buf); err != nil {
+		framed.pool.Put(buf)
+		return nil, err
+	}
+	return &PooledFrame{pool: framed.pool, buf: buf, length: nb}, nil
+}
+
+/*
+WriteFrameFrom writes pf's bytes as a single frame and then releases pf back
+to its pool, regardless of whether the write succeeded.
+*/
+func (framed *Writer) WriteFrameFrom(pf *PooledFrame) (n int, err error) {
+	defer pf.Release()
+	return framed.Write(pf.Bytes())
+}
@@ -0,0 +1,97 @@
+package framed
+
+import (
+	"math"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestBucketFor(t *testing.T) {
+	assert.Equal(t, 1, bucketFor(0), "bucketFor(0)")
+	assert.Equal(t, 1, bucketFor(1), "bucketFor(1)")
+	assert.Equal(t, 2, bucketFor(2), "bucketFor(2)")
+	assert.Equal(t, 4, bucketFor(3), "bucketFor(3)")
+	assert.Equal(t, 128, bucketFor(100), "bucketFor(100)")
+	assert.Equal(t, math.MaxInt32, bucketFor(math.MaxInt32+1), "bucketFor should cap rather than overflow for n beyond math.MaxInt32")
+}
+
+func TestSyncPoolBufferPoolGetPut(t *testing.T) {
+	pool := NewSyncPoolBufferPool()
+
+	buf := pool.Get(10)
+	assert.Len(t, *buf, 10, "Get should return a buffer of exactly the requested length")
+
+	pool.Put(buf)
+
+	buf2 := pool.Get(10)
+	assert.Len(t, *buf2, 10, "A reused buffer should still be resliced to the requested length")
+}
+
+func TestPooledFrameBytes(t *testing.T) {
+	pool := NewSyncPoolBufferPool()
+	buf := pool.Get(5)
+	copy(*buf, "hello")
+
+	pf := &PooledFrame{pool: pool, buf: buf, length: 5}
+	assert.Equal(t, "hello", string(pf.Bytes()), "Bytes should return the frame's content")
+}
+
+func TestPooledFrameBytesAfterReleasePanics(t *testing.T) {
+	pool := NewSyncPoolBufferPool()
+	buf := pool.Get(5)
+	pf := &PooledFrame{pool: pool, buf: buf, length: 5}
+	pf.Release()
+
+	assert.Panics(t, func() { pf.Bytes() }, "Bytes after Release should panic")
+}
+
+func TestPooledFrameDoubleReleasePanics(t *testing.T) {
+	pool := NewSyncPoolBufferPool()
+	buf := pool.Get(5)
+	pf := &PooledFrame{pool: pool, buf: buf, length: 5}
+	pf.Release()
+
+	assert.Panics(t, func() { pf.Release() }, "Releasing a PooledFrame twice should panic")
+}
+
+func TestReadFrameFromPoolRequiresPool(t *testing.T) {
+	p := newPipe()
+	defer p.Close()
+
+	reader := NewReader(p)
+	_, err := reader.ReadFrameFromPool()
+	assert.Error(t, err, "ReadFrameFromPool should fail on a Reader not constructed with NewReaderWithPool")
+}
+
+func TestReadFrameFromPoolAndWriteFrameFromRoundTrip(t *testing.T) {
+	p := newPipe()
+	defer p.Close()
+
+	pool := NewSyncPoolBufferPool()
+	writer := NewWriter(p)
+	reader := NewReaderWithPool(p, pool)
+
+	go writer.Write([]byte("hello"))
+
+	pf, err := reader.ReadFrameFromPool()
+	if assert.NoError(t, err, "Unable to read frame from pool") {
+		assert.Equal(t, "hello", string(pf.Bytes()), "Wrong frame content read from pool")
+		pf.Release()
+	}
+}
+
+func TestWriteFrameFromReleasesEvenOnError(t *testing.T) {
+	pool := NewSyncPoolBufferPool()
+	buf := pool.Get(5)
+	copy(*buf, "hello")
+	pf := &PooledFrame{pool: pool, buf: buf, length: 5}
+
+	p := newPipe()
+	p.Close()
+	writer := NewWriter(p)
+
+	_, err := writer.WriteFrameFrom(pf)
+	assert.Error(t, err, "Writing to a closed Stream should fail")
+	assert.Panics(t, func() { pf.Release() }, "WriteFrameFrom should have already released pf even though the write failed")
+}
@@ -0,0 +1,126 @@
+package framed
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+A PrefixEncoding identifies how a Reader or Writer encodes the length prefix
+that precedes each frame. Switching a Reader's Prefix away from Uint16LE
+also raises its default MaxFrameLength accordingly; see
+Reader.defaultMaxFrameLength.
+*/
+type PrefixEncoding int
+
+const (
+	// Uint16LE encodes the length as an unsigned 16-bit little-endian
+	// integer, capping frames at MAX_FRAME_SIZE. This is the default and
+	// matches the original framed wire format.
+	Uint16LE PrefixEncoding = iota
+	// Uint32BE encodes the length as an unsigned 32-bit big-endian integer,
+	// for frames too large for Uint16LE ("big frames").
+	Uint32BE
+	// Uvarint encodes the length as a protobuf-style unsigned varint via
+	// binary.PutUvarint/binary.ReadUvarint: 1 byte for lengths below 128,
+	// up to 10 bytes for arbitrary 64-bit sizes. Combine with MaxFrameLength
+	// to bound how large a frame a peer can ask a Reader to allocate.
+	Uvarint
+)
+
+// defaultMaxFrameLength returns the MaxFrameLength to enforce when a Reader
+// hasn't set one explicitly. Uint16LE can't encode a length past
+// MAX_FRAME_SIZE in the first place, but Uint32BE and Uvarint exist
+// specifically so callers can send frames bigger than that, so defaulting
+// them to MAX_FRAME_SIZE too would silently reject the very frames those
+// modes were added to support.
+func (framed *Reader) defaultMaxFrameLength() int {
+	switch framed.Prefix {
+	case Uint32BE, Uvarint:
+		return math.MaxInt32
+	default:
+		return MAX_FRAME_SIZE
+	}
+}
+
+/*
+byteReader adapts an io.Reader that doesn't implement io.ByteReader (as
+required by binary.ReadUvarint) by issuing a Read with a 1-byte slice per
+byte requested. Construct a Reader with NewReaderSize to avoid this
+per-byte overhead.
+*/
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (framed *Reader) readLengthPrefix() (int, error) {
+	switch framed.Prefix {
+	case Uint32BE:
+		var nb uint32
+		if err := binary.Read(framed.Stream, binary.BigEndian, &nb); err != nil {
+			return 0, err
+		}
+		return int(nb), nil
+	case Uvarint:
+		var br io.ByteReader
+		if framed.br != nil {
+			br = framed.br
+		} else {
+			br = byteReader{framed.Stream}
+		}
+		nb, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, err
+		}
+		// A peer can encode a length up to MaxUint64 in a varint, which
+		// overflows a negative Go int on conversion. checkMaxFrameLength
+		// never rejects a negative length (it's never > max), so that
+		// would otherwise reach make([]byte, nb) or buffer[:nb] and panic.
+		// Reject it here, before any allocation is attempted.
+		if nb > math.MaxInt32 {
+			return 0, fmt.Errorf("frame length %d exceeds the maximum representable length of %d", nb, math.MaxInt32)
+		}
+		return int(nb), nil
+	default:
+		var nb uint16
+		if err := binary.Read(framed.Stream, endianness, &nb); err != nil {
+			return 0, err
+		}
+		return int(nb), nil
+	}
+}
+
+// encodeLengthPrefix encodes n as a length prefix without writing it,
+// so that callers such as WritePieces can coalesce it with the frame's
+// payload into a single vectored write.
+func (framed *Writer) encodeLengthPrefix(n int) []byte {
+	switch framed.Prefix {
+	case Uint32BE:
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(n))
+		return buf
+	case Uvarint:
+		buf := make([]byte, binary.MaxVarintLen64)
+		nw := binary.PutUvarint(buf, uint64(n))
+		return buf[:nw]
+	default:
+		buf := make([]byte, 2)
+		endianness.PutUint16(buf, uint16(n))
+		return buf
+	}
+}
+
+func (framed *Writer) writeLengthPrefix(n int) error {
+	_, err := framed.Stream.Write(framed.encodeLengthPrefix(n))
+	return err
+}
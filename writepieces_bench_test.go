@@ -0,0 +1,78 @@
+package framed
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// loopbackConn dials a fresh TCP loopback connection, handing the accepted
+// side's bytes to ioutil.Discard so the benchmark only measures the write
+// path.
+func loopbackConn(b *testing.B) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Unable to listen: %s", err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatalf("Unable to dial: %s", err)
+	}
+	return conn
+}
+
+func benchmarkWritePieces(b *testing.B, pieceSize, numPieces int) {
+	conn := loopbackConn(b)
+	defer conn.Close()
+
+	writer := NewWriter(conn)
+	pieces := make([][]byte, numPieces)
+	for i := range pieces {
+		pieces[i] = make([]byte, pieceSize)
+	}
+
+	b.SetBytes(int64(pieceSize * numPieces))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := writer.WritePieces(pieces...); err != nil {
+			b.Fatalf("Unable to write pieces: %s", err)
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, pieceSize, numPieces int) {
+	conn := loopbackConn(b)
+	defer conn.Close()
+
+	writer := NewWriter(conn)
+	frame := make([]byte, pieceSize*numPieces)
+
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := writer.Write(frame); err != nil {
+			b.Fatalf("Unable to write: %s", err)
+		}
+	}
+}
+
+// BenchmarkWritePieces measures WritePieces, which coalesces the header and
+// every piece into a single net.Buffers.WriteTo call.
+func BenchmarkWritePieces(b *testing.B) {
+	benchmarkWritePieces(b, 512, 4)
+}
+
+// BenchmarkWrite measures Write as a single-piece baseline for comparison
+// against BenchmarkWritePieces' vectored write.
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrite(b, 512, 4)
+}